@@ -7,9 +7,14 @@ package freegeoip
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
@@ -18,10 +23,8 @@ import (
 	"strings"
 	"sync"
 	"time"
-	"log"
 
 	"github.com/howeyc/fsnotify"
-	"github.com/oschwald/maxminddb-golang"
 )
 
 var (
@@ -30,49 +33,124 @@ var (
 	// downloaded in background.
 	ErrUnavailable = errors.New("no database available")
 
+	// ErrAuthFailed is returned by the MaxMind update protocol when the
+	// account ID and license key are rejected by the metadata service.
+	// It is sent through NotifyError without triggering further retries.
+	ErrAuthFailed = errors.New("maxmind: authentication failed, check account id and license key")
+
 	// Local cached copy of a database downloaded from a URL.
-	defaultDB = filepath.Join(os.TempDir(), "freegeoip", "db")
+	defaultDB      = filepath.Join(os.TempDir(), "freegeoip", "db")
 	defaultArchive = filepath.Join(os.TempDir(), "freegeoip", "db.gz")
+
+	// Local cached copy of the optional ASN database.
+	defaultASNDB      = filepath.Join(os.TempDir(), "freegeoip", "asn.db")
+	defaultASNArchive = filepath.Join(os.TempDir(), "freegeoip", "asn.gz")
 )
 
-// DB is the IP geolocation database.
+// maxMindUpdateHost is the host serving MaxMind's geoipupdate v6 protocol,
+// used by OpenMaxMind to fetch metadata and database downloads.
+const maxMindUpdateHost = "updates.maxmind.com"
+
+// maxMindMetadata is the response of the MaxMind metadata endpoint for a
+// single edition, used to decide whether a newer database is available
+// without downloading it.
+type maxMindMetadata struct {
+	EditionID    string `json:"edition_id"`
+	SHA256       string `json:"sha256"`
+	LastModified string `json:"last_modified"`
+}
+
+// DB is the IP geolocation database. It always holds the main city/
+// country database, and optionally a second ASN database loaded and
+// kept up to date independently, mirroring how the two are distributed
+// and versioned separately by MaxMind.
 type DB struct {
-	file        string            // Database file name.
-	reader      *maxminddb.Reader // Actual db object.
-	notifyQuit  chan struct{}     // Stop auto-update and watch goroutines.
-	notifyOpen  chan string       // Notify when a db file is open.
-	notifyError chan error        // Notify when an error occurs.
-	notifyInfo  chan string       // Notify random actions for logging
-	closed      bool              // Mark this db as closed.
-	lastUpdated time.Time         // Last time the db was updated.
-	mu          sync.RWMutex      // Protects all the above.
+	main *dbFile // City/country database.
+	asn  *dbFile // ASN database, nil if not configured.
+
+	notifyQuit  chan struct{} // Stop auto-update and watch goroutines.
+	notifyOpen  chan string   // Notify when a db file is open.
+	notifyError chan error    // Notify when an error occurs.
+	notifyInfo  chan string   // Notify random actions for logging
+	closed      bool          // Mark this db as closed.
+	mu          sync.RWMutex  // Protects closed and the notify channels above.
+
+	ctx    context.Context // Canceled when the db is closed, derived from notifyQuit.
+	cancel context.CancelFunc
+
+	metrics *dbMetrics // Prometheus instruments, exported via Collector.
+}
+
+// dbFile is a single MaxMind database (city/country or ASN) along with
+// everything needed to keep it updated independently: its own reader,
+// its own update/retry state, and, if applicable, its own MaxMind
+// update credentials. Each dbFile is watched and auto-updated by its
+// own goroutine; db is used only to deliver notifications and to check
+// whether the owning DB has been closed.
+type dbFile struct {
+	db   *DB    // Parent DB, used for notifications.
+	name string // Label used in log/notify messages, e.g. "city" or "asn".
+
+	file        string       // Database file name.
+	backend     string       // Reader backend for file, decided once at construction time from its extension (see backendFor) so promote doesn't have to re-derive it from a mangled temp name.
+	reader      Reader       // Actual db object; backend dispatched by newReaderForBackend.
+	lastUpdated time.Time    // Last time the db was updated.
+	mu          sync.RWMutex // Protects reader and lastUpdated.
+
+	// archive is the local cached copy of the compressed database. If
+	// empty, file is assumed to already be a ready-to-use database (see
+	// Open), and openFile opens it directly instead of extracting it.
+	archive string
 
 	updateInterval   time.Duration // Update interval.
 	maxRetryInterval time.Duration // Max retry interval in case of failure.
+
+	accountID  int    // MaxMind account ID, set when using the MaxMind protocol.
+	licenseKey string // MaxMind license key, set when using the MaxMind protocol.
+	editionID  string // MaxMind edition ID (e.g. GeoLite2-City or GeoLite2-ASN).
+
+	httpClient *http.Client // Client used for update requests, defaults to http.DefaultClient.
 }
 
-// Open creates and initializes a DB from a local file.
+// permanentError wraps an error that autoUpdateMaxMind does not retry,
+// such as an authentication failure.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Open creates and initializes a DB from a local file, already in one
+// of the formats backendFor recognises (mmdb, ip2region's xdb, DB-IP's
+// csv/csv.gz); the backend is picked from the file's extension, see
+// backendFor. An optional second argument points to an
+// ASN database (e.g. GeoLite2-ASN.mmdb), enabling LookupASN.
 //
-// The database file is monitored by fsnotify and automatically
-// reloads when the file is updated or overwritten.
-func Open(dsn string) (*DB, error) {
-	d := &DB{
-		file:        dsn,
-		notifyQuit:  make(chan struct{}),
-		notifyOpen:  make(chan string, 1),
-		notifyError: make(chan error, 1),
-		notifyInfo:  make(chan string, 1),
-	}
-	err := d.openFile()
-	if err != nil {
+// The database files are monitored by fsnotify and automatically
+// reload when updated or overwritten.
+func Open(dsn string, asnDSN ...string) (*DB, error) {
+	d := newDB()
+	d.main = d.newDBFile("city", dsn)
+	if err := d.main.openFile(); err != nil {
 		d.Close()
 		return nil, err
 	}
-	err = d.watchFile()
-	if err != nil {
+	if err := d.main.watchFile(); err != nil {
 		d.Close()
 		return nil, fmt.Errorf("fsnotify failed for %s: %s", dsn, err)
 	}
+	if len(asnDSN) > 0 && asnDSN[0] != "" {
+		d.asn = d.newDBFile("asn", asnDSN[0])
+		if err := d.asn.openFile(); err != nil {
+			d.Close()
+			return nil, err
+		}
+		if err := d.asn.watchFile(); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fsnotify failed for %s: %s", asnDSN[0], err)
+		}
+	}
 	return d, nil
 }
 
@@ -86,49 +164,128 @@ func MaxMindUpdateURL(hostname, productID, licenseKey string) (string, error) {
 
 // OpenURL creates and initializes a DB from a URL.
 // It automatically downloads and updates the file in background, and
-// keeps a local copy on $TMPDIR.
-func OpenURL(url string, updateInterval, maxRetryInterval time.Duration) (*DB, error) {
-	d := &DB{
-		file:             defaultDB,
-		notifyQuit:       make(chan struct{}),
-		notifyOpen:       make(chan string, 1),
-		notifyError:      make(chan error, 1),
-		notifyInfo:       make(chan string, 1),
-		updateInterval:   updateInterval,
-		maxRetryInterval: maxRetryInterval,
-	}
-	d.openFile() // Optional, might fail.
-	go d.autoUpdate(url)
-	err := d.watchFile()
-	if err != nil {
+// keeps a local copy on $TMPDIR. An optional second URL points to an
+// ASN database, downloaded and updated on its own schedule.
+func OpenURL(url string, updateInterval, maxRetryInterval time.Duration, asnURL ...string) (*DB, error) {
+	return OpenURLWithClient(url, http.DefaultClient, updateInterval, maxRetryInterval, asnURL...)
+}
+
+// OpenURLWithClient is like OpenURL, but performs update requests with
+// client instead of http.DefaultClient. This lets callers configure
+// proxies, TLS settings, and per-request timeouts for the update
+// traffic without affecting the rest of the process.
+func OpenURLWithClient(url string, client *http.Client, updateInterval, maxRetryInterval time.Duration, asnURL ...string) (*DB, error) {
+	d := newDB()
+	d.main = d.newDBFile("city", defaultDB)
+	d.main.archive = defaultArchive
+	d.main.updateInterval = updateInterval
+	d.main.maxRetryInterval = maxRetryInterval
+	d.main.httpClient = client
+	d.main.openFile() // Optional, might fail.
+	go d.main.autoUpdate(url)
+	if err := d.main.watchFile(); err != nil {
 		d.Close()
-		return nil, fmt.Errorf("fsnotify failed for %s: %s", d.file, err)
+		return nil, fmt.Errorf("fsnotify failed for %s: %s", d.main.file, err)
+	}
+
+	if len(asnURL) > 0 && asnURL[0] != "" {
+		d.asn = d.newDBFile("asn", defaultASNDB)
+		d.asn.archive = defaultASNArchive
+		d.asn.updateInterval = updateInterval
+		d.asn.maxRetryInterval = maxRetryInterval
+		d.asn.httpClient = client
+		d.asn.openFile() // Optional, might fail.
+		go d.asn.autoUpdate(asnURL[0])
+		if err := d.asn.watchFile(); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fsnotify failed for %s: %s", d.asn.file, err)
+		}
+	}
+	return d, nil
+}
+
+// OpenMaxMind creates and initializes a DB that updates itself using
+// MaxMind's metadata + direct download protocol (the one used by
+// geoipupdate v6), identified by the given account ID, license key and
+// edition ID (e.g. "GeoLite2-City"). It keeps a local copy on $TMPDIR,
+// alongside a cached SHA-256 of the database it was built from, so
+// restarts don't re-download a database that hasn't changed. An
+// optional ASN edition ID (e.g. "GeoLite2-ASN") enables LookupASN,
+// updated independently of the main database.
+//
+// OpenURL remains available for the legacy HEAD-plus-Last-Modified
+// update protocol.
+func OpenMaxMind(accountID int, licenseKey, editionID string, updateInterval, maxRetryInterval time.Duration, asnEditionID ...string) (*DB, error) {
+	d := newDB()
+	d.main = d.newDBFile("city", defaultDB)
+	d.main.updateInterval = updateInterval
+	d.main.maxRetryInterval = maxRetryInterval
+	d.main.accountID = accountID
+	d.main.licenseKey = licenseKey
+	d.main.editionID = editionID
+	d.main.openFile() // Optional, might fail.
+	go d.main.autoUpdateMaxMind()
+	if err := d.main.watchFile(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("fsnotify failed for %s: %s", d.main.file, err)
+	}
+
+	if len(asnEditionID) > 0 && asnEditionID[0] != "" {
+		d.asn = d.newDBFile("asn", defaultASNDB)
+		d.asn.updateInterval = updateInterval
+		d.asn.maxRetryInterval = maxRetryInterval
+		d.asn.accountID = accountID
+		d.asn.licenseKey = licenseKey
+		d.asn.editionID = asnEditionID[0]
+		d.asn.openFile() // Optional, might fail.
+		go d.asn.autoUpdateMaxMind()
+		if err := d.asn.watchFile(); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fsnotify failed for %s: %s", d.asn.file, err)
+		}
 	}
 	return d, nil
 }
 
-func (d *DB) watchFile() error {
+func newDB() *DB {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DB{
+		notifyQuit:  make(chan struct{}),
+		notifyOpen:  make(chan string, 1),
+		notifyError: make(chan error, 1),
+		notifyInfo:  make(chan string, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		metrics:     newDBMetrics(),
+	}
+}
+
+func (d *DB) newDBFile(name, file string) *dbFile {
+	return &dbFile{db: d, name: name, file: file, backend: backendFor(file), httpClient: http.DefaultClient}
+}
+
+func (f *dbFile) watchFile() error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	dbdir, err := d.makeDir()
+	dbdir, err := f.makeDir()
 	if err != nil {
 		return err
 	}
-	go d.watchEvents(watcher)
+	go f.watchEvents(watcher)
 	return watcher.Watch(dbdir)
 }
 
-func (d *DB) watchEvents(watcher *fsnotify.Watcher) {
+func (f *dbFile) watchEvents(watcher *fsnotify.Watcher) {
 	for {
 		select {
 		case ev := <-watcher.Event:
-			if ev.Name == d.file && (ev.IsCreate() || ev.IsModify()) {
-				d.openFile()
+			if ev.Name == f.file && (ev.IsCreate() || ev.IsModify()) {
+				f.openFile()
 			}
 		case <-watcher.Error:
-		case <-d.notifyQuit:
+		case <-f.db.notifyQuit:
 			watcher.Close()
 			return
 		}
@@ -136,61 +293,80 @@ func (d *DB) watchEvents(watcher *fsnotify.Watcher) {
 	}
 }
 
-func (d *DB) openFile() error {
-	_, err := d.ProcessFile()
+func (f *dbFile) openFile() error {
+	if f.archive == "" {
+		return f.openLocalFile()
+	}
+	tmpfile, err := f.ProcessFile()
 	if err != nil {
 		return err
 	}
-	reader, err := d.newReader(d.file)
+	return f.promote(tmpfile)
+}
+
+// openLocalFile opens f.file directly and installs it as the active
+// reader, without going through extractArchive/promote. It's used when
+// f has no configured archive, i.e. it was handed an already-extracted
+// database (see Open), so there is nothing to extract and no temp file
+// to atomically swap in.
+func (f *dbFile) openLocalFile() error {
+	reader, err := f.newReader(f.file)
 	if err != nil {
 		return err
 	}
-	stat, err := os.Stat(d.file)
+	stat, err := os.Stat(f.file)
 	if err != nil {
+		reader.Close()
 		return err
 	}
-	d.setReader(reader, stat.ModTime())
+	f.setReader(reader, stat.ModTime())
+	f.recordPromotion(reader)
 	return nil
 }
 
-func (d *DB) newReader(dbfile string) (*maxminddb.Reader, error) {
-	return maxminddb.Open(dbfile)
+// newReader opens dbfile with f's configured backend. The backend is
+// decided once, at construction time, from f.file's extension
+// (see backendFor) rather than dbfile's, since dbfile is often a
+// tmpFilePath whose name doesn't preserve the original extension.
+func (f *dbFile) newReader(dbfile string) (Reader, error) {
+	return newReaderForBackend(f.backend, dbfile)
 }
 
-func (d *DB) setReader(reader *maxminddb.Reader, modtime time.Time) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.closed {
+func (f *dbFile) setReader(reader Reader, modtime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db.isClosed() {
 		reader.Close()
 		return
 	}
-	if d.reader != nil {
-		d.reader.Close()
+	if f.reader != nil {
+		f.reader.Close()
 	}
-	d.reader = reader
-	d.lastUpdated = modtime.UTC()
+	f.reader = reader
+	f.lastUpdated = modtime.UTC()
 	select {
-	case d.notifyOpen <- d.file:
+	case f.db.notifyOpen <- f.file:
 	default:
 	}
 }
 
-func (d *DB) autoUpdate(url string) {
+func (f *dbFile) autoUpdate(url string) {
 	backoff := time.Second
 	for {
-		d.sendInfo("starting update")
-		err := d.runUpdate(url)
+		f.db.sendInfo(f.name + ": starting update")
+		err := f.runUpdate(url)
+		f.recordUpdateResult(err == nil)
 		if err != nil {
 			bs := backoff.Seconds()
-			ms := d.maxRetryInterval.Seconds()
+			ms := f.maxRetryInterval.Seconds()
 			backoff = time.Duration(math.Min(bs*math.E, ms)) * time.Second
-			d.sendError(fmt.Errorf("download failed (will retry in %s): %s", backoff, err))
+			f.db.sendError(fmt.Errorf("%s: download failed (will retry in %s): %s", f.name, backoff, err))
 		} else {
-			backoff = d.updateInterval
+			backoff = f.updateInterval
 		}
-		d.sendInfo("finished update")
+		f.db.sendInfo(f.name + ": finished update")
 		select {
-		case <-d.notifyQuit:
+		case <-f.db.notifyQuit:
 			return
 		case <-time.After(backoff):
 			// Sleep till time for the next update attempt.
@@ -198,33 +374,37 @@ func (d *DB) autoUpdate(url string) {
 	}
 }
 
-func (d *DB) runUpdate(url string) error {
-	yes, err := d.needUpdate(url)
+func (f *dbFile) runUpdate(url string) error {
+	yes, err := f.needUpdate(url)
 	if err != nil {
 		return err
 	}
 	if !yes {
 		return nil
 	}
-	tmpfile, err := d.download(url)
+	archive, err := f.download(url)
 	if err != nil {
 		return err
 	}
-	err = d.renameFile(tmpfile)
+	defer os.RemoveAll(archive)
+	tmpfile, err := f.extractArchive(archive)
 	if err != nil {
-		// Cleanup the tempfile if renaming failed.
-		os.RemoveAll(tmpfile)
+		return err
 	}
-	return err
+	return f.promote(tmpfile)
 }
 
-func (d *DB) needUpdate(url string) (bool, error) {
-	stat, err := os.Stat(defaultArchive)
+func (f *dbFile) needUpdate(url string) (bool, error) {
+	stat, err := os.Stat(f.archivePath())
 	if err != nil {
 		return true, nil // Local db is missing, must be downloaded.
 	}
 
-	resp, err := http.Head(url)
+	req, err := http.NewRequestWithContext(f.db.ctx, "HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := f.httpClient.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -247,28 +427,192 @@ func (d *DB) needUpdate(url string) (bool, error) {
 	return false, nil
 }
 
-func (d *DB) download(url string) (tmpfile string, err error) {
-	resp, err := http.Get(url)
+func (f *dbFile) download(url string) (tmpfile string, err error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(f.db.ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 	tmpfile = filepath.Join(os.TempDir(),
-		fmt.Sprintf("_freegeoip.%d.db.gz", time.Now().UnixNano()))
-	f, err := os.Create(tmpfile)
+		fmt.Sprintf("_freegeoip.%s.%d.db.gz", f.name, time.Now().UnixNano()))
+	fh, err := os.Create(tmpfile)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, resp.Body)
+	defer fh.Close()
+	n, err := io.Copy(fh, resp.Body)
 	if err != nil {
 		return "", err
 	}
+	f.recordDownload(n, time.Since(start))
 	return tmpfile, nil
 }
 
-func (d *DB) makeDir() (dbdir string, err error) {
-	dbdir = filepath.Dir(d.file)
+func (f *dbFile) autoUpdateMaxMind() {
+	backoff := time.Second
+	for {
+		f.db.sendInfo(f.name + ": starting update")
+		err := f.runUpdateMaxMind()
+		f.recordUpdateResult(err == nil)
+		if err != nil {
+			if _, ok := err.(*permanentError); ok {
+				f.db.sendError(fmt.Errorf("%s: %s", f.name, err))
+				return
+			}
+			bs := backoff.Seconds()
+			ms := f.maxRetryInterval.Seconds()
+			backoff = time.Duration(math.Min(bs*math.E, ms)) * time.Second
+			f.db.sendError(fmt.Errorf("%s: download failed (will retry in %s): %s", f.name, backoff, err))
+		} else {
+			backoff = f.updateInterval
+		}
+		f.db.sendInfo(f.name + ": finished update")
+		select {
+		case <-f.db.notifyQuit:
+			return
+		case <-time.After(backoff):
+			// Sleep till time for the next update attempt.
+		}
+	}
+}
+
+func (f *dbFile) runUpdateMaxMind() error {
+	meta, err := f.fetchMaxMindMetadata()
+	if err != nil {
+		return err
+	}
+	localHash := f.readLocalHash()
+	if localHash != "" && localHash == meta.SHA256 {
+		return nil
+	}
+	archive, hash, err := f.downloadMaxMind(localHash)
+	if err != nil {
+		return err
+	}
+	if archive == "" {
+		// Server confirmed the local copy is still current (304).
+		return f.writeLocalHash(meta.SHA256)
+	}
+	defer os.RemoveAll(archive)
+	if hash != meta.SHA256 {
+		return fmt.Errorf("maxmind: downloaded database checksum mismatch for edition %s", f.editionID)
+	}
+	tmpfile, err := f.extractArchive(archive)
+	if err != nil {
+		return err
+	}
+	if err := f.promote(tmpfile); err != nil {
+		return err
+	}
+	return f.writeLocalHash(hash)
+}
+
+// fetchMaxMindMetadata retrieves the current SHA-256 hash and last-modified
+// timestamp of f.editionID from MaxMind's metadata endpoint.
+func (f *dbFile) fetchMaxMindMetadata() (*maxMindMetadata, error) {
+	u := fmt.Sprintf("https://%s/geoip/updates/metadata?edition_id=%s", maxMindUpdateHost, f.editionID)
+	req, err := http.NewRequestWithContext(f.db.ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(fmt.Sprintf("%d", f.accountID), f.licenseKey)
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, &permanentError{ErrAuthFailed}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("maxmind: metadata request failed with status %s", resp.Status)
+	}
+	var metas []maxMindMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metas); err != nil {
+		return nil, err
+	}
+	for i := range metas {
+		if metas[i].EditionID == f.editionID {
+			return &metas[i], nil
+		}
+	}
+	return nil, fmt.Errorf("maxmind: no metadata found for edition %s", f.editionID)
+}
+
+// downloadMaxMind fetches the tar.gz archive for f.editionID, sending the
+// locally cached database hash so the server can short-circuit with a
+// 304 Not Modified. It returns the path to the downloaded archive and
+// the SHA-256 of its contents.
+func (f *dbFile) downloadMaxMind(localHash string) (tmpfile, hash string, err error) {
+	start := time.Now()
+	u := fmt.Sprintf("https://%s/geoip/databases/%s/download?db_md5=%s&suffix=tar.gz",
+		maxMindUpdateHost, f.editionID, localHash)
+	req, err := http.NewRequestWithContext(f.db.ctx, "GET", u, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.SetBasicAuth(fmt.Sprintf("%d", f.accountID), f.licenseKey)
+	req.Header.Set("X-Db-Md5", localHash)
+	if localHash != "" {
+		req.Header.Set("If-None-Match", localHash)
+	}
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", "", &permanentError{ErrAuthFailed}
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return "", "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("maxmind: download request failed with status %s", resp.Status)
+	}
+	tmpfile = filepath.Join(os.TempDir(),
+		fmt.Sprintf("_freegeoip.%s.%d.db.gz", f.name, time.Now().UnixNano()))
+	fh, err := os.Create(tmpfile)
+	if err != nil {
+		return "", "", err
+	}
+	defer fh.Close()
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fh, sum), resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	f.recordDownload(n, time.Since(start))
+	return tmpfile, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// localHashPath returns the path of the file that caches the SHA-256 of
+// the downloaded archive the database at f.file was extracted from,
+// used to avoid
+// re-downloading an unchanged database across restarts.
+func (f *dbFile) localHashPath() string {
+	return f.file + ".sha256"
+}
+
+func (f *dbFile) readLocalHash() string {
+	b, err := ioutil.ReadFile(f.localHashPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (f *dbFile) writeLocalHash(hash string) error {
+	return ioutil.WriteFile(f.localHashPath(), []byte(hash), 0644)
+}
+
+func (f *dbFile) makeDir() (dbdir string, err error) {
+	dbdir = filepath.Dir(f.file)
 	_, err = os.Stat(dbdir)
 	if err != nil {
 		err = os.MkdirAll(dbdir, 0755)
@@ -279,21 +623,138 @@ func (d *DB) makeDir() (dbdir string, err error) {
 	return dbdir, nil
 }
 
-func (d *DB) renameFile(name string) error {
-	os.Rename(d.file, d.file+".bak") // Optional, might fail.
-	_, err := d.makeDir()
+// tmpFilePath returns a unique path in the same directory as f.file, so
+// that extracting a new database into it and later promoting it stay on
+// one filesystem, making the final rename atomic.
+func (f *dbFile) tmpFilePath() string {
+	return filepath.Join(filepath.Dir(f.file),
+		fmt.Sprintf(".%s.tmp.%d", filepath.Base(f.file), time.Now().UnixNano()))
+}
+
+// archivePath returns the path of the locally cached compressed
+// database, if this dbFile was configured with one.
+func (f *dbFile) archivePath() string {
+	return f.archive
+}
+
+// extractArchive extracts the database entry out of the tar.gz at
+// archivePath into a fresh temp file alongside f.file, ready to be
+// handed to promote. Which entry counts as "the database" is decided by
+// archiveEntryMatch, based on f.backend. It's an error for nothing in
+// the archive to match: that means the archive doesn't hold the kind of
+// database f was configured for.
+func (f *dbFile) extractArchive(archivePath string) (string, error) {
+	fh, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	if _, err := f.makeDir(); err != nil {
+		return "", err
+	}
+	tmpfile := f.tmpFilePath()
+	err, matched := ExtractTarGz(fh, tmpfile, f.archiveEntryMatch())
+	if err != nil {
+		return "", err
+	}
+	if matched == "" {
+		return "", fmt.Errorf("%s: no entry in %s matched backend %q", f.name, archivePath, f.backend)
+	}
+	return tmpfile, nil
+}
+
+// archiveEntryMatch returns the predicate used to pick the database
+// entry out of a tar.gz archive, based on f.backend: ip2region ships a
+// ".xdb" file and DB-IP ships a ".csv.gz" dump, while mmdb (the
+// default) falls back to the legacy mmdb/BIN substring match used by
+// MaxMind's distribution archives.
+func (f *dbFile) archiveEntryMatch() func(name string) bool {
+	switch f.backend {
+	case "ip2region":
+		return func(name string) bool { return strings.HasSuffix(strings.ToLower(name), ".xdb") }
+	case "dbip":
+		return func(name string) bool { return strings.HasSuffix(strings.ToLower(name), ".csv.gz") }
+	default:
+		return func(name string) bool {
+			return strings.Contains(name, "mmdb") || strings.Contains(name, "BIN")
+		}
+	}
+}
+
+// promote opens tmpfile with the backend dispatched for it (which
+// sanity-checks its metadata as part of opening) and atomically swaps
+// it in as f.file. The previous database is kept at f.file+".bak": if
+// opening the new database or the final rename fails, it is restored
+// so f.file is never left missing or corrupt. setReader takes care of
+// not closing the outgoing reader until in-flight Lookup RLock holders
+// have drained.
+func (f *dbFile) promote(tmpfile string) error {
+	bakfile := f.file + ".bak"
+	hadPrevious := os.Rename(f.file, bakfile) == nil
+
+	reader, err := f.newReader(tmpfile)
+	if err != nil {
+		os.RemoveAll(tmpfile)
+		f.restoreBackup(hadPrevious, bakfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, f.file); err != nil {
+		reader.Close()
+		os.RemoveAll(tmpfile)
+		f.restoreBackup(hadPrevious, bakfile)
+		return err
+	}
+	stat, err := os.Stat(f.file)
 	if err != nil {
+		reader.Close()
 		return err
 	}
-	return os.Rename(name, d.file)
+	f.setReader(reader, stat.ModTime())
+	f.recordPromotion(reader)
+	return nil
+}
+
+// restoreBackup moves f.file+".bak" back onto f.file when a previous
+// database existed and the promotion that displaced it did not succeed.
+func (f *dbFile) restoreBackup(hadPrevious bool, bakfile string) {
+	if hadPrevious {
+		os.Rename(bakfile, f.file)
+	}
+}
+
+// Verify walks the mmdb tree decoding every record, returning the first
+// error encountered. It can be used to validate the currently active
+// database without replacing it, mirroring the health checks update
+// tooling such as mihomo runs before activating a database. Backends
+// other than mmdb don't expose a tree to walk and always report healthy.
+func (d *DB) Verify() error {
+	return d.main.verify()
+}
+
+func (f *dbFile) verify() error {
+	f.mu.RLock()
+	reader := f.reader
+	f.mu.RUnlock()
+	if reader == nil {
+		return ErrUnavailable
+	}
+	if mr, ok := reader.(*mmdbReader); ok {
+		return mr.verify()
+	}
+	return nil
 }
 
 // Date returns the UTC date the database file was last modified.
 // If no database file has been opened the behaviour of Date is undefined.
 func (d *DB) Date() time.Time {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	return d.lastUpdated
+	return d.main.date()
+}
+
+func (f *dbFile) date() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.lastUpdated
 }
 
 // NotifyClose returns a channel that is closed when the database is closed.
@@ -320,6 +781,12 @@ func (d *DB) NotifyInfo() <-chan string {
 	return d.notifyInfo
 }
 
+func (d *DB) isClosed() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.closed
+}
+
 func (d *DB) sendError(err error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -351,10 +818,58 @@ func (d *DB) sendInfo(message string) {
 //
 // See the DefaultQuery for an example of the result struct.
 func (d *DB) Lookup(addr net.IP, result interface{}) error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	if d.reader != nil {
-		return d.reader.Lookup(addr, result)
+	return d.main.lookup(addr, result)
+}
+
+// LookupASN performs an ASN database lookup of the given IP address, and
+// stores the response into the result value. It returns ErrUnavailable
+// if the DB wasn't configured with an ASN database (see Open, OpenURL
+// and OpenMaxMind). See DefaultASNQuery for an example of the result
+// struct.
+func (d *DB) LookupASN(addr net.IP, result interface{}) error {
+	if d.asn == nil {
+		return ErrUnavailable
+	}
+	return d.asn.lookup(addr, result)
+}
+
+// LookupCtx is like Lookup, but returns ctx.Err() without performing the
+// lookup if ctx is already canceled. The underlying reader lookup is
+// synchronous and is not itself interrupted by ctx once started.
+func (d *DB) LookupCtx(ctx context.Context, addr net.IP, result interface{}) error {
+	return d.main.lookupCtx(ctx, addr, result)
+}
+
+// LookupASNCtx is the context-aware variant of LookupASN. See LookupCtx.
+func (d *DB) LookupASNCtx(ctx context.Context, addr net.IP, result interface{}) error {
+	if d.asn == nil {
+		return ErrUnavailable
+	}
+	return d.asn.lookupCtx(ctx, addr, result)
+}
+
+func (f *dbFile) lookupCtx(ctx context.Context, addr net.IP, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.lookup(addr, result)
+}
+
+func (f *dbFile) lookup(addr net.IP, result interface{}) error {
+	if !f.db.metrics.isEnabled() {
+		return f.lookupReader(addr, result)
+	}
+	start := time.Now()
+	err := f.lookupReader(addr, result)
+	f.recordLookup(time.Since(start), err)
+	return err
+}
+
+func (f *dbFile) lookupReader(addr net.IP, result interface{}) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.reader != nil {
+		return f.reader.Lookup(addr, result)
 	}
 	return ErrUnavailable
 }
@@ -362,7 +877,7 @@ func (d *DB) Lookup(addr net.IP, result interface{}) error {
 // DefaultQuery is the default query used for database lookups.
 type DefaultQuery struct {
 	Continent struct {
-		Code string `maxminddb:"code"`
+		Code  string            `maxminddb:"code"`
 		Names map[string]string `maxminddb:"names"`
 	} `maxminddb:"continent"`
 	Country struct {
@@ -377,50 +892,67 @@ type DefaultQuery struct {
 		Names map[string]string `maxminddb:"names"`
 	} `maxminddb:"city"`
 	Location struct {
-		Latitude  float64 `maxminddb:"latitude"`
-		Longitude float64 `maxminddb:"longitude"`
-		MetroCode uint    `maxminddb:"metro_code"`
-		TimeZone  string  `maxminddb:"time_zone"`
-		AccuracyRadius  uint  `maxminddb:"accuracy_radius"`
+		Latitude       float64 `maxminddb:"latitude"`
+		Longitude      float64 `maxminddb:"longitude"`
+		MetroCode      uint    `maxminddb:"metro_code"`
+		TimeZone       string  `maxminddb:"time_zone"`
+		AccuracyRadius uint    `maxminddb:"accuracy_radius"`
 	} `maxminddb:"location"`
 	Postal struct {
 		Code string `maxminddb:"code"`
 	} `maxminddb:"postal"`
 }
 
+// DefaultASNQuery is the default query used for ASN database lookups,
+// against GeoLite2-ASN or GeoIP2-ISP.
+type DefaultASNQuery struct {
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
 // Close closes the database.
 func (d *DB) Close() {
 	d.mu.Lock()
-	defer d.mu.Unlock()
 	if !d.closed {
 		d.closed = true
 		close(d.notifyQuit)
 		close(d.notifyOpen)
 		close(d.notifyError)
 		close(d.notifyInfo)
+		d.cancel()
 	}
-	if d.reader != nil {
-		d.reader.Close()
-		d.reader = nil
+	d.mu.Unlock()
+	if d.main != nil {
+		d.main.close()
 	}
-}
-
-func (d *DB) ProcessFile() (string, error) {
-	f, err := os.Open(defaultArchive)
-	if err != nil {
-		return "", err
+	if d.asn != nil {
+		d.asn.close()
 	}
-	defer f.Close()
+}
 
-	err, _ = d.ExtractTarGz(f)
-	if err != nil {
-		return "", err
+func (f *dbFile) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
 	}
-	return d.file, nil
 }
 
+// ProcessFile extracts f's configured archive into a fresh temp file.
+// It's only called by openFile when f.archive is set; a dbFile with no
+// archive opens f.file directly instead (see openLocalFile).
+func (f *dbFile) ProcessFile() (string, error) {
+	return f.extractArchive(f.archive)
+}
 
-func (d *DB) ExtractTarGz(gzipStream io.Reader) (error, string) {
+// ExtractTarGz extracts the first regular file in gzipStream whose name
+// matches into destPath. destPath should live on the same filesystem as
+// the database file it will be promoted into, since callers rename it
+// into place afterwards. match lets callers pick the right entry for
+// the backend they're extracting (e.g. "*.mmdb" for MaxMind archives,
+// "*.xdb" for ip2region, "*.csv.gz" for DB-IP).
+func ExtractTarGz(gzipStream io.Reader, destPath string, match func(name string) bool) (error, string) {
 	uncompressedStream, err := gzip.NewReader(gzipStream)
 	if err != nil {
 		return err, ""
@@ -440,25 +972,26 @@ func (d *DB) ExtractTarGz(gzipStream io.Reader) (error, string) {
 		}
 
 		switch header.Typeflag {
-		case tar.TypeDir:
-			break;
 		case tar.TypeReg:
-			if strings.Contains(header.Name, "mmdb") || strings.Contains(header.Name, "BIN") {
-				outFile, err := os.Create(d.file)
+			if match(header.Name) {
+				outFile, err := os.Create(destPath)
 				if err != nil {
 					return err, ""
 				}
 				defer outFile.Close()
 				if _, err := io.Copy(outFile, tarReader); err != nil {
 					return err, ""
-				}else{
-					return nil, d.file
+				} else {
+					return nil, destPath
 				}
 			}
 		default:
-			log.Fatalf("ExtractTarGz: uknown type: %b in %s", header.Typeflag, header.Name)
+			// Directories, symlinks, hardlinks and anything else a
+			// third-party archive might include aren't the database
+			// entry we're looking for; skip them instead of failing
+			// the whole extraction over an entry we don't care about.
 		}
 	}
 
 	return nil, ""
-}
\ No newline at end of file
+}
@@ -0,0 +1,175 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildTarGz packs entries (archive entry name -> contents) into an
+// in-memory tar.gz archive, as produced by MaxMind/ip2region/DB-IP
+// distribution downloads.
+func buildTarGz(t *testing.T, entries map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDBFileExtractAndPromoteNonMMDB drives a full extract-archive ->
+// promote cycle for a non-mmdb backend, the same path OpenURL and
+// OpenMaxMind use on every update: an ip2region archive must come out
+// the other end as a working ip2region reader, not silently resolve to
+// mmdb because of the backend the temp file's mangled name implies.
+func TestDBFileExtractAndPromoteNonMMDB(t *testing.T) {
+	dir := t.TempDir()
+	ip, region := "0.0.3.4", "China|0|Beijing|Beijing|Chinanet"
+	archive := filepath.Join(dir, "region.tar.gz")
+	writeFile(t, archive, buildTarGz(t, map[string][]byte{
+		"ip2region.xdb": buildIP2RegionFixture(t, ip, region),
+	}))
+
+	d := newDB()
+	defer d.Close()
+	f := d.newDBFile("city", filepath.Join(dir, "city.xdb"))
+	f.archive = archive
+
+	if err := f.openFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var q Ip2RegionQuery
+	if err := f.lookup(net.ParseIP(ip), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country != "China" || q.City != "Beijing" {
+		t.Fatalf("unexpected query result: %+v", q)
+	}
+}
+
+// TestDBFileExtractArchiveNoMatch verifies that an archive with no
+// entry matching the configured backend fails loudly, instead of
+// silently handing promote a temp path that was never written to.
+func TestDBFileExtractArchiveNoMatch(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "region.tar.gz")
+	writeFile(t, archive, buildTarGz(t, map[string][]byte{
+		"readme.txt": []byte("nothing useful here"),
+	}))
+
+	d := newDB()
+	defer d.Close()
+	f := d.newDBFile("city", filepath.Join(dir, "city.xdb"))
+	f.archive = archive
+
+	if _, err := f.extractArchive(f.archive); err == nil {
+		t.Fatal("expected an error when no archive entry matches the backend")
+	} else if !strings.Contains(err.Error(), "no entry") {
+		t.Fatalf("expected a \"no entry matched\" error, got: %v", err)
+	}
+}
+
+// TestExtractTarGzSkipsNonRegularEntries verifies that a symlink entry
+// ahead of the real database entry (as some distributors ship, e.g. a
+// "latest" symlink) is skipped rather than aborting the whole
+// extraction, since ExtractTarGz runs on remote/vendor-supplied
+// archives it doesn't control the contents of.
+func TestExtractTarGzSkipsNonRegularEntries(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "latest",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "GeoLite2-City_20250101/GeoLite2-City.mmdb",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("mmdb content")
+	if err := tw.WriteHeader(&tar.Header{Name: "GeoLite2-City.mmdb", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "out")
+	err, matched := ExtractTarGz(&buf, dest, func(name string) bool {
+		return strings.HasSuffix(name, ".mmdb")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != dest {
+		t.Fatalf("got matched %q, want %q", matched, dest)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("got content %q, want %q", got, content)
+	}
+}
+
+// TestOpenLocalFile verifies that Open reads an already-extracted local
+// database directly, instead of assuming file is the destination of an
+// extraction out of an archive that was never configured.
+func TestOpenLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "city.csv")
+	writeFile(t, path, []byte("1.2.3.0,1.2.3.255,US,CA,San Francisco\n"))
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var q DefaultDBIPQuery
+	if err := db.Lookup(net.ParseIP("1.2.3.4"), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country != "US" || q.City != "San Francisco" {
+		t.Fatalf("unexpected query result: %+v", q)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dbMetrics holds the Prometheus instruments shared by a DB's
+// dbFile(s), one time series per database (labeled "db", e.g. "city" or
+// "asn"). It is always created, but the instruments are only touched
+// once Collector has been called at least once: enabled is an atomic
+// flag so recording a metric is a single branch when nobody is
+// scraping, rather than a prometheus.Vec lookup on every lookup/update.
+type dbMetrics struct {
+	enabled int32
+
+	lastUpdated      *prometheus.GaugeVec
+	updateAttempts   *prometheus.CounterVec
+	downloadBytes    *prometheus.CounterVec
+	downloadDuration *prometheus.HistogramVec
+	buildEpoch       *prometheus.GaugeVec
+	lookupDuration   *prometheus.HistogramVec
+	lookupErrors     *prometheus.CounterVec
+}
+
+func newDBMetrics() *dbMetrics {
+	return &dbMetrics{
+		lastUpdated: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "freegeoip_db_last_updated_timestamp_seconds",
+			Help: "Unix timestamp of the last successful database update.",
+		}, []string{"db"}),
+		updateAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "freegeoip_db_update_attempts_total",
+			Help: "Count of database update attempts, by result.",
+		}, []string{"db", "result"}),
+		downloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "freegeoip_db_download_bytes_total",
+			Help: "Total bytes downloaded while updating the database.",
+		}, []string{"db"}),
+		downloadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "freegeoip_db_download_duration_seconds",
+			Help: "Time spent downloading database updates.",
+		}, []string{"db"}),
+		buildEpoch: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "freegeoip_db_build_epoch_seconds",
+			Help: "Build epoch reported by the active database's metadata.",
+		}, []string{"db"}),
+		lookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "freegeoip_lookup_duration_seconds",
+			Help: "Time spent performing database lookups.",
+		}, []string{"db"}),
+		lookupErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "freegeoip_lookup_errors_total",
+			Help: "Count of failed database lookups.",
+		}, []string{"db"}),
+	}
+}
+
+func (m *dbMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.lastUpdated,
+		m.updateAttempts,
+		m.downloadBytes,
+		m.downloadDuration,
+		m.buildEpoch,
+		m.lookupDuration,
+		m.lookupErrors,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *dbMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *dbMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *dbMetrics) isEnabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Collector returns a prometheus.Collector exporting the update
+// lifecycle and lookup latency metrics for d and, if configured, its
+// ASN database. Metrics start being recorded as soon as Collector is
+// called; register the result with a prometheus.Registerer to scrape
+// them.
+func (d *DB) Collector() prometheus.Collector {
+	atomic.StoreInt32(&d.metrics.enabled, 1)
+	return d.metrics
+}
+
+func (f *dbFile) recordUpdateResult(success bool) {
+	if !f.db.metrics.isEnabled() {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	f.db.metrics.updateAttempts.WithLabelValues(f.name, result).Inc()
+}
+
+func (f *dbFile) recordDownload(n int64, dur time.Duration) {
+	if !f.db.metrics.isEnabled() {
+		return
+	}
+	f.db.metrics.downloadBytes.WithLabelValues(f.name).Add(float64(n))
+	f.db.metrics.downloadDuration.WithLabelValues(f.name).Observe(dur.Seconds())
+}
+
+func (f *dbFile) recordPromotion(reader Reader) {
+	if !f.db.metrics.isEnabled() {
+		return
+	}
+	f.db.metrics.lastUpdated.WithLabelValues(f.name).Set(float64(time.Now().Unix()))
+	if build := reader.Metadata().BuildTime; !build.IsZero() {
+		f.db.metrics.buildEpoch.WithLabelValues(f.name).Set(float64(build.Unix()))
+	}
+}
+
+func (f *dbFile) recordLookup(dur time.Duration, err error) {
+	if !f.db.metrics.isEnabled() {
+		return
+	}
+	f.db.metrics.lookupDuration.WithLabelValues(f.name).Observe(dur.Seconds())
+	if err != nil {
+		f.db.metrics.lookupErrors.WithLabelValues(f.name).Inc()
+	}
+}
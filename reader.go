@@ -0,0 +1,165 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Reader is the interface a database backend must implement to be used
+// by DB. It abstracts over the on-disk format so DB doesn't need to
+// know whether it's reading an mmdb, an ip2region xdb, a DB-IP CSV
+// dump, or a proprietary format plugged in via RegisterReaderFactory.
+type Reader interface {
+	// Lookup looks up addr and decodes the result into result, following
+	// whatever convention the backend supports (e.g. maxminddb's
+	// tag-based struct decoding, or a flat delimited string).
+	Lookup(addr net.IP, result interface{}) error
+
+	// Close releases any resources held by the reader.
+	Close() error
+
+	// Metadata describes the database the reader was opened from.
+	Metadata() Metadata
+}
+
+// Metadata describes a database, independently of its on-disk backend.
+type Metadata struct {
+	Format      string    // Backend that produced this reader, e.g. "mmdb".
+	BuildTime   time.Time // When the vendor built this edition, if known.
+	Description string    // Free-form description of the edition, if known.
+}
+
+// readerFactory opens a Reader from a local file path.
+type readerFactory func(path string) (Reader, error)
+
+var (
+	readerFactoriesMu sync.RWMutex
+	readerFactories   = map[string]readerFactory{}
+)
+
+// RegisterReaderFactory registers a Reader backend under name. Built-in
+// backends ("mmdb", "ip2region", "dbip") are registered the same way, in
+// this package's init. Since backendFor only ever picks one of those
+// three names, registering under one of them replaces that built-in
+// backend (e.g. with a reader for an IPinfo mmdb variant); a factory
+// registered under any other name is not chosen for any file.
+//
+// RegisterReaderFactory is not safe to call concurrently with Open,
+// OpenURL or OpenMaxMind; register custom backends during program
+// initialization.
+func RegisterReaderFactory(name string, factory func(path string) (Reader, error)) {
+	readerFactoriesMu.Lock()
+	defer readerFactoriesMu.Unlock()
+	readerFactories[name] = factory
+}
+
+func lookupReaderFactory(name string) (readerFactory, bool) {
+	readerFactoriesMu.RLock()
+	defer readerFactoriesMu.RUnlock()
+	factory, ok := readerFactories[name]
+	return factory, ok
+}
+
+func init() {
+	RegisterReaderFactory("mmdb", newMMDBReader)
+	RegisterReaderFactory("ip2region", newIP2RegionReader)
+	RegisterReaderFactory("dbip", newDBIPReader)
+}
+
+// backendFor detects which registered backend should open path, based
+// on its extension alone: the file's contents are not inspected, and
+// any path it doesn't recognise is treated as mmdb. It only ever
+// returns "mmdb", "ip2region" or "dbip".
+func backendFor(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xdb":
+		return "ip2region"
+	case ".csv":
+		return "dbip"
+	case ".gz":
+		if strings.HasSuffix(strings.ToLower(path), ".csv.gz") {
+			return "dbip"
+		}
+	}
+	return "mmdb"
+}
+
+// newReaderForFile opens path with whichever registered backend claims
+// to handle it.
+func newReaderForFile(path string) (Reader, error) {
+	return newReaderForBackend(backendFor(path), path)
+}
+
+// newReaderForBackend opens path with the registered backend named
+// backend, bypassing extension sniffing. Used once the
+// backend has already been decided (e.g. by dbFile, since a promoted
+// temp file's name doesn't preserve the original extension).
+func newReaderForBackend(backend, path string) (Reader, error) {
+	factory, ok := lookupReaderFactory(backend)
+	if !ok {
+		return nil, fmt.Errorf("freegeoip: no reader registered for backend %q (file %s)", backend, path)
+	}
+	return factory(path)
+}
+
+// mmdbReader adapts *maxminddb.Reader to the Reader interface.
+type mmdbReader struct {
+	reader *maxminddb.Reader
+}
+
+func newMMDBReader(path string) (Reader, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Metadata.NodeCount == 0 {
+		reader.Close()
+		return nil, errors.New("mmdb: database has zero node count")
+	}
+	if reader.Metadata.BuildEpoch == 0 {
+		reader.Close()
+		return nil, errors.New("mmdb: database is missing a build epoch")
+	}
+	return &mmdbReader{reader: reader}, nil
+}
+
+func (r *mmdbReader) Lookup(addr net.IP, result interface{}) error {
+	return r.reader.Lookup(addr, result)
+}
+
+func (r *mmdbReader) Close() error {
+	return r.reader.Close()
+}
+
+func (r *mmdbReader) Metadata() Metadata {
+	return Metadata{
+		Format:      "mmdb",
+		BuildTime:   time.Unix(int64(r.reader.Metadata.BuildEpoch), 0).UTC(),
+		Description: r.reader.Metadata.DatabaseType,
+	}
+}
+
+// verify walks the mmdb tree decoding every record, returning the first
+// error encountered. Other backends don't expose a tree to walk, so
+// dbFile.verify only does this for mmdb readers.
+func (r *mmdbReader) verify() error {
+	networks := r.reader.Networks()
+	var record interface{}
+	for networks.Next() {
+		if _, err := networks.Network(&record); err != nil {
+			return fmt.Errorf("mmdb: corrupt record: %s", err)
+		}
+	}
+	return networks.Err()
+}
@@ -0,0 +1,140 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+)
+
+// dbipRecord is one row of a DB-IP CSV database: an IPv4 range and the
+// attributes associated with it (country, region, city, in that order
+// when present).
+type dbipRecord struct {
+	start, end            uint32
+	country, region, city string
+}
+
+// dbipReader reads DB-IP's CSV database format (e.g. dbip-city-lite.csv)
+// by loading it fully into memory, sorted by range start, and binary
+// searching it on lookup. This approximates the bsearch-over-mmap index
+// DB-IP's own tools use, without requiring a memory-mapping dependency.
+type dbipReader struct {
+	records []dbipRecord
+}
+
+// DefaultDBIPQuery is the default query used for DB-IP lookups.
+type DefaultDBIPQuery struct {
+	Country string
+	Region  string
+	City    string
+}
+
+func newDBIPReader(path string) (Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Detect gzip by its magic bytes rather than a ".gz" suffix, since a
+	// .csv.gz entry extracted from an archive is opened from a temp path.
+	br := bufio.NewReader(f)
+	var csvReader *csv.Reader
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("dbip: %s", err)
+		}
+		defer gz.Close()
+		csvReader = csv.NewReader(gz)
+	} else {
+		csvReader = csv.NewReader(br)
+	}
+	csvReader.FieldsPerRecord = -1
+
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("dbip: %s", err)
+	}
+
+	records := make([]dbipRecord, 0, len(rows))
+	for _, row := range rows {
+		rec, ok := parseDBIPRow(row)
+		if ok {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].start < records[j].start })
+	return &dbipReader{records: records}, nil
+}
+
+// parseDBIPRow converts a CSV row into a dbipRecord. IPv6-only rows are
+// skipped, matching the IPv4 focus of DefaultDBIPQuery.
+func parseDBIPRow(row []string) (dbipRecord, bool) {
+	if len(row) < 2 {
+		return dbipRecord{}, false
+	}
+	start := ipv4ToUint32(row[0])
+	end := ipv4ToUint32(row[1])
+	if start == 0 && end == 0 {
+		return dbipRecord{}, false
+	}
+	rec := dbipRecord{start: start, end: end}
+	if len(row) > 2 {
+		rec.country = row[2]
+	}
+	if len(row) > 3 {
+		rec.region = row[3]
+	}
+	if len(row) > 4 {
+		rec.city = row[4]
+	}
+	return rec, true
+}
+
+func ipv4ToUint32(s string) uint32 {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func (r *dbipReader) Close() error {
+	r.records = nil
+	return nil
+}
+
+func (r *dbipReader) Metadata() Metadata {
+	return Metadata{Format: "dbip-csv"}
+}
+
+func (r *dbipReader) Lookup(addr net.IP, result interface{}) error {
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return fmt.Errorf("dbip: only IPv4 addresses are supported")
+	}
+	ipVal := binary.BigEndian.Uint32(ip4)
+
+	i := sort.Search(len(r.records), func(i int) bool { return r.records[i].end >= ipVal })
+	if i == len(r.records) || r.records[i].start > ipVal {
+		return ErrUnavailable
+	}
+	rec := r.records[i]
+
+	v, ok := result.(*DefaultDBIPQuery)
+	if !ok {
+		return fmt.Errorf("dbip: unsupported result type %T, want *DefaultDBIPQuery", result)
+	}
+	v.Country, v.Region, v.City = rec.country, rec.region, rec.city
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ip2regionHeaderSize is the size, in bytes, of the xdb header block.
+const ip2regionHeaderSize = 256
+
+// ip2regionVectorIndexCols is the width, in entries, of the first-level
+// vector index: one entry per possible (byte0, byte1) pair of the
+// address being looked up.
+const ip2regionVectorIndexCols = 256
+
+// ip2regionVectorIndexEntrySize is the size, in bytes, of a single
+// vector index entry: a (firstIndexPtr, lastIndexPtr) pair.
+const ip2regionVectorIndexEntrySize = 8
+
+// ip2regionIndexBlockSize is the size, in bytes, of a single segment
+// index block: startIP(4) + endIP(4) + dataLen(2) + dataPtr(4).
+const ip2regionIndexBlockSize = 14
+
+// ip2regionReader reads ip2region's v2 "xdb" format: a btree-like
+// binary index (a 256x256 vector index narrowing down to a run of
+// segment index blocks, binary searched by IP) over a region string
+// such as "country|region|province|city|isp".
+type ip2regionReader struct {
+	f *os.File
+}
+
+// Ip2RegionQuery is the default query used for ip2region lookups. It
+// mirrors the pipe-delimited region string ip2region stores per segment.
+type Ip2RegionQuery struct {
+	Country  string
+	Region   string
+	Province string
+	City     string
+	ISP      string
+}
+
+func newIP2RegionReader(path string) (Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, ip2regionHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("ip2region: reading header: %s", err)
+	}
+	return &ip2regionReader{f: f}, nil
+}
+
+func (r *ip2regionReader) Close() error {
+	return r.f.Close()
+}
+
+func (r *ip2regionReader) Metadata() Metadata {
+	return Metadata{Format: "ip2region"}
+}
+
+func (r *ip2regionReader) Lookup(addr net.IP, result interface{}) error {
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return errors.New("ip2region: only IPv4 addresses are supported")
+	}
+	ipVal := binary.BigEndian.Uint32(ip4)
+
+	vectorOffset := int64(ip2regionHeaderSize) +
+		int64(ip4[0])*ip2regionVectorIndexCols*ip2regionVectorIndexEntrySize +
+		int64(ip4[1])*ip2regionVectorIndexEntrySize
+	vectorEntry := make([]byte, ip2regionVectorIndexEntrySize)
+	if _, err := r.f.ReadAt(vectorEntry, vectorOffset); err != nil {
+		return fmt.Errorf("ip2region: reading vector index: %s", err)
+	}
+	firstPtr := binary.LittleEndian.Uint32(vectorEntry[0:4])
+	lastPtr := binary.LittleEndian.Uint32(vectorEntry[4:8])
+	if firstPtr == 0 && lastPtr == 0 {
+		return ErrUnavailable
+	}
+
+	region, err := r.search(ipVal, int64(firstPtr), int64(lastPtr))
+	if err != nil {
+		return err
+	}
+	return decodeIP2Region(region, result)
+}
+
+// search binary-searches the segment index blocks between [low, high]
+// (inclusive, byte offsets into the file) for the one spanning ipVal,
+// and returns its region string.
+func (r *ip2regionReader) search(ipVal uint32, low, high int64) (string, error) {
+	block := make([]byte, ip2regionIndexBlockSize)
+	for low <= high {
+		mid := low + (((high-low)/ip2regionIndexBlockSize)/2)*ip2regionIndexBlockSize
+		if _, err := r.f.ReadAt(block, mid); err != nil {
+			return "", fmt.Errorf("ip2region: reading index block: %s", err)
+		}
+		startIP := binary.LittleEndian.Uint32(block[0:4])
+		endIP := binary.LittleEndian.Uint32(block[4:8])
+		switch {
+		case ipVal < startIP:
+			high = mid - ip2regionIndexBlockSize
+		case ipVal > endIP:
+			low = mid + ip2regionIndexBlockSize
+		default:
+			dataLen := binary.LittleEndian.Uint16(block[8:10])
+			dataPtr := binary.LittleEndian.Uint32(block[10:14])
+			data := make([]byte, dataLen)
+			if _, err := r.f.ReadAt(data, int64(dataPtr)); err != nil {
+				return "", fmt.Errorf("ip2region: reading region data: %s", err)
+			}
+			return string(data), nil
+		}
+	}
+	return "", ErrUnavailable
+}
+
+// decodeIP2Region fills result with an ip2region "country|region|
+// province|city|isp" string, supporting *string (raw) and
+// *Ip2RegionQuery (split into fields).
+func decodeIP2Region(region string, result interface{}) error {
+	switch v := result.(type) {
+	case *string:
+		*v = region
+	case *Ip2RegionQuery:
+		fields := strings.SplitN(region, "|", 5)
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		v.Country, v.Region, v.Province, v.City, v.ISP =
+			fields[0], fields[1], fields[2], fields[3], fields[4]
+	default:
+		return fmt.Errorf("ip2region: unsupported result type %T, want *string or *Ip2RegionQuery", result)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2009 The freegeoip authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package freegeoip
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildIP2RegionFixture returns the bytes of a minimal, valid ip2region
+// v2 xdb file: a zeroed header, a single vector-index entry pointing at
+// a single segment index block, and that block's region data. ip's
+// first two octets must be 0 so the vector entry lands right after the
+// header, keeping the fixture small.
+func buildIP2RegionFixture(t *testing.T, ip, region string) []byte {
+	t.Helper()
+	ipVal := ipv4ToUint32(ip)
+
+	vectorOffset := int64(ip2regionHeaderSize)
+	blockOffset := vectorOffset + ip2regionVectorIndexEntrySize
+	dataOffset := blockOffset + ip2regionIndexBlockSize
+
+	buf := make([]byte, dataOffset+int64(len(region)))
+	binary.LittleEndian.PutUint32(buf[vectorOffset:], uint32(blockOffset))   // firstPtr
+	binary.LittleEndian.PutUint32(buf[vectorOffset+4:], uint32(blockOffset)) // lastPtr
+	binary.LittleEndian.PutUint32(buf[blockOffset:], ipVal)                  // startIP
+	binary.LittleEndian.PutUint32(buf[blockOffset+4:], ipVal)                // endIP
+	binary.LittleEndian.PutUint16(buf[blockOffset+8:], uint16(len(region)))  // dataLen
+	binary.LittleEndian.PutUint32(buf[blockOffset+10:], uint32(dataOffset))  // dataPtr
+	copy(buf[dataOffset:], region)
+	return buf
+}
+
+func TestIP2RegionReaderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.xdb")
+	ip, region := "0.0.3.4", "China|0|Beijing|Beijing|Chinanet"
+	if err := os.WriteFile(path, buildIP2RegionFixture(t, ip, region), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newReaderForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Metadata().Format != "ip2region" {
+		t.Fatalf("got format %q, want ip2region", r.Metadata().Format)
+	}
+
+	var q Ip2RegionQuery
+	if err := r.Lookup(net.ParseIP(ip), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country != "China" || q.City != "Beijing" {
+		t.Fatalf("unexpected query result: %+v", q)
+	}
+}
+
+func TestDBIPReaderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.csv")
+	csv := "1.2.3.0,1.2.3.255,US,CA,San Francisco\n"
+	if err := os.WriteFile(path, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newReaderForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Metadata().Format != "dbip-csv" {
+		t.Fatalf("got format %q, want dbip-csv", r.Metadata().Format)
+	}
+
+	var q DefaultDBIPQuery
+	if err := r.Lookup(net.ParseIP("1.2.3.4"), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Country != "US" || q.Region != "CA" || q.City != "San Francisco" {
+		t.Fatalf("unexpected query result: %+v", q)
+	}
+}
+
+func TestBackendFor(t *testing.T) {
+	cases := map[string]string{
+		"GeoLite2-City.mmdb":    "mmdb",
+		"region.xdb":            "ip2region",
+		"dbip-city-lite.csv":    "dbip",
+		"dbip-city-lite.csv.gz": "dbip",
+		"db.gz":                 "mmdb",
+	}
+	for path, want := range cases {
+		if got := backendFor(path); got != want {
+			t.Errorf("backendFor(%q) = %q, want %q", path, got, want)
+		}
+	}
+}